@@ -1,7 +1,11 @@
 package afero
 
 import (
+	"encoding/gob"
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -10,28 +14,285 @@ import (
 // a possibly writeable layer on top. Changes to the file system will only
 // be made in the overlay: Changing an existing file in the base layer which
 // is not present in the overlay will copy the file to the overlay ("changing"
-// includes also calls to e.g. Chtimes() and Chmod()).
-// The overlay is currently limited to MemMapFs:
-//  - missing MkdirAll() calls in the code below, MemMapFs creates them
-//    implicitly (or better: records the full path and afero.Readdir()
-//    can handle this).
+// includes also calls to e.g. Chtimes() and Chmod()). Any Fs implementation
+// may be used on either side.
 //
-// Reading directories is currently only supported via Open(), not OpenFile().
+// Open() and OpenFile() both merge directory entries from base and layer
+// into a single UnionFile, regardless of which side the directory was
+// opened through or which side only has some of its children; layer
+// entries win over base entries of the same name.
+//
+// Deleting a file that only exists in the base layer does not touch the
+// base layer: instead a whiteout marker is written to the overlay
+// recording the deletion, so that the path is treated as absent by
+// Stat/Open/OpenFile even though the base layer still has it. RemoveAll on
+// a directory present in the base layer writes a directory-level opaque
+// marker instead of one whiteout per child, masking the whole base
+// subtree in a single step; the directory itself stays in the union,
+// empty. Recreating a whited-out path (via Create, OpenFile with O_CREATE,
+// Mkdir or MkdirAll) clears the marker, except that Mkdir and MkdirAll
+// report EEXIST for any path that is a directory in the base layer.
+//
+// Copy-up behavior is controlled by a CowOptions passed to
+// NewCopyOnWriteFsWithOptions: whether Chmod/Chtimes copy the full file or
+// just record the changed metadata in a sidecar (folded into the real
+// content on the first copy-up that needs it), a maximum size above which
+// copy-up is refused, and a callback fired on every copy-up.
 type CopyOnWriteUnionFs struct {
 	base  Fs
 	layer Fs
+	opts  CowOptions
+}
+
+// CowOptions controls the copy-up behavior of a CopyOnWriteUnionFs created
+// via NewCopyOnWriteFsWithOptions. The zero value reproduces the historical
+// behavior: every copy-up duplicates the full file content into the layer,
+// with no size limit and no callback.
+type CowOptions struct {
+	// MetadataOnlyCopyUp makes Chmod/Chtimes on a base-only file record the
+	// new mode/mtime in a small sidecar in the layer instead of copying the
+	// file's data. The override is folded into the layer copy (and the
+	// sidecar removed) the first time the data itself is copied up.
+	MetadataOnlyCopyUp bool
+
+	// MaxCopySize, if non-zero, caps the size of a file that may be copied
+	// up from base to layer. Copy-up of a larger file returns
+	// ErrCopyUpTooLarge instead of buffering the whole file.
+	MaxCopySize int64
+
+	// OnCopyUp, if set, is called after every successful copy-up (full or
+	// metadata-only) with the path that was copied, for metrics/logging.
+	OnCopyUp func(name string)
+}
+
+// ErrCopyUpTooLarge is returned by a copy-up that would exceed
+// CowOptions.MaxCopySize.
+var ErrCopyUpTooLarge = errors.New("afero: file too large to copy up")
+
+// NewCopyOnWriteFs creates a new CopyOnWriteUnionFs using the default
+// CowOptions (full copy-up, no size limit, no callback).
+func NewCopyOnWriteFs(base Fs, layer Fs) Fs {
+	return NewCopyOnWriteFsWithOptions(base, layer, CowOptions{})
+}
+
+// NewCopyOnWriteFsWithOptions is like NewCopyOnWriteFs but lets the caller
+// control copy-up behavior via opts.
+func NewCopyOnWriteFsWithOptions(base Fs, layer Fs, opts CowOptions) Fs {
+	return &CopyOnWriteUnionFs{base: base, layer: layer, opts: opts}
+}
+
+// whPrefix marks a whiteout file: an empty file in the overlay recording
+// that the sibling of the same name (without the prefix) has been deleted
+// from the base layer.
+const whPrefix = ".wh."
+
+// whOpaque is a directory-level whiteout: its presence in an overlay
+// directory masks every base-layer child of that directory.
+const whOpaque = ".wh..wh..opq"
+
+func whiteoutPath(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, whPrefix+base)
+}
+
+func opaquePath(name string) string {
+	return filepath.Join(name, whOpaque)
+}
+
+// isOpaque reports whether name or one of its ancestors has been masked by
+// a directory-level whiteout in the layer.
+func (u *CopyOnWriteUnionFs) isOpaque(name string) (bool, error) {
+	if name == "." || name == string(filepath.Separator) || name == "" {
+		return false, nil
+	}
+	_, err := u.layer.Stat(opaquePath(name))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	return u.isOpaque(filepath.Dir(name))
+}
+
+// isWhiteout reports whether name has been deleted in the overlay, either
+// via its own whiteout marker or because an ancestor directory is opaque.
+func (u *CopyOnWriteUnionFs) isWhiteout(name string) (bool, error) {
+	_, err := u.layer.Stat(whiteoutPath(name))
+	if err == nil {
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	return u.isOpaque(filepath.Dir(name))
+}
+
+// clearWhiteout removes a whiteout marker for name, if any, so that a path
+// being (re)created no longer appears deleted.
+func (u *CopyOnWriteUnionFs) clearWhiteout(name string) error {
+	err := u.layer.Remove(whiteoutPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (u *CopyOnWriteUnionFs) writeWhiteout(name string) error {
+	if err := u.layer.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return err
+	}
+	f, err := u.layer.Create(whiteoutPath(name))
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (u *CopyOnWriteUnionFs) writeOpaque(name string) error {
+	// The opaque marker lives inside the directory being masked, so the
+	// directory itself (not just its parent) must exist in the layer.
+	if err := u.layer.MkdirAll(name, 0o777); err != nil {
+		return err
+	}
+	f, err := u.layer.Create(opaquePath(name))
+	if err != nil {
+		return err
+	}
+	return f.Close()
 }
 
 func (u *CopyOnWriteUnionFs) isBaseFile(name string) (bool, error) {
 	if _, err := u.layer.Stat(name); err == nil {
 		return false, nil
 	}
-	_, err := u.base.Stat(name)
+	whiteout, err := u.isWhiteout(name)
+	if err != nil {
+		return false, err
+	}
+	if whiteout {
+		return false, syscall.ENOENT
+	}
+	_, err = u.base.Stat(name)
 	return true, err
 }
 
+// metaPath is the sidecar path recording a pending metadata-only copy-up
+// for name.
+func metaPath(name string) string {
+	dir, base := filepath.Split(name)
+	return filepath.Join(dir, ".cow-meta."+base)
+}
+
+// cowMeta is the content of a metadata-only copy-up sidecar.
+type cowMeta struct {
+	Mode  os.FileMode
+	Mtime time.Time
+}
+
+func (u *CopyOnWriteUnionFs) readMeta(name string) (cowMeta, bool, error) {
+	f, err := u.layer.Open(metaPath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cowMeta{}, false, nil
+		}
+		return cowMeta{}, false, err
+	}
+	defer f.Close()
+	var meta cowMeta
+	if err := gob.NewDecoder(f).Decode(&meta); err != nil {
+		return cowMeta{}, false, err
+	}
+	return meta, true, nil
+}
+
+func (u *CopyOnWriteUnionFs) removeMeta(name string) error {
+	err := u.layer.Remove(metaPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeMetaOverride records a metadata-only copy-up for name: mode and/or
+// mtime (whichever is non-nil) are merged into any existing sidecar, or
+// into the base file's current metadata if there is none yet.
+func (u *CopyOnWriteUnionFs) writeMetaOverride(name string, mode *os.FileMode, mtime *time.Time) error {
+	meta, ok, err := u.readMeta(name)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		bfi, err := u.base.Stat(name)
+		if err != nil {
+			return err
+		}
+		meta = cowMeta{Mode: bfi.Mode(), Mtime: bfi.ModTime()}
+	}
+	if mode != nil {
+		meta.Mode = *mode
+	}
+	if mtime != nil {
+		meta.Mtime = *mtime
+	}
+	if err := u.layer.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return err
+	}
+	f, err := u.layer.Create(metaPath(name))
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(meta); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if u.opts.OnCopyUp != nil {
+		u.opts.OnCopyUp(name)
+	}
+	return nil
+}
+
+// copyToLayer copies name from base into the layer, materializing any
+// missing parent directories first so the layer need not be a MemMapFs.
+// It refuses files larger than CowOptions.MaxCopySize, folds in any
+// pending metadata-only override recorded by writeMetaOverride, and fires
+// CowOptions.OnCopyUp on success.
 func (u *CopyOnWriteUnionFs) copyToLayer(name string) error {
-	return copyToLayer(u.base, u.layer, name)
+	if err := u.layer.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return err
+	}
+	if u.opts.MaxCopySize > 0 {
+		fi, err := u.base.Stat(name)
+		if err != nil {
+			return err
+		}
+		if fi.Size() > u.opts.MaxCopySize {
+			return ErrCopyUpTooLarge
+		}
+	}
+	if err := copyToLayer(u.base, u.layer, name); err != nil {
+		return err
+	}
+	if meta, ok, err := u.readMeta(name); err != nil {
+		return err
+	} else if ok {
+		if err := u.layer.Chmod(name, meta.Mode); err != nil {
+			return err
+		}
+		if err := u.layer.Chtimes(name, meta.Mtime, meta.Mtime); err != nil {
+			return err
+		}
+		if err := u.removeMeta(name); err != nil {
+			return err
+		}
+	}
+	if u.opts.OnCopyUp != nil {
+		u.opts.OnCopyUp(name)
+	}
+	return nil
 }
 
 func (u *CopyOnWriteUnionFs) Chtimes(name string, atime, mtime time.Time) error {
@@ -40,6 +301,9 @@ func (u *CopyOnWriteUnionFs) Chtimes(name string, atime, mtime time.Time) error
 		return err
 	}
 	if b {
+		if u.opts.MetadataOnlyCopyUp {
+			return u.writeMetaOverride(name, nil, &mtime)
+		}
 		if err := u.copyToLayer(name); err != nil {
 			return err
 		}
@@ -53,6 +317,9 @@ func (u *CopyOnWriteUnionFs) Chmod(name string, mode os.FileMode) error {
 		return err
 	}
 	if b {
+		if u.opts.MetadataOnlyCopyUp {
+			return u.writeMetaOverride(name, &mode, nil)
+		}
 		if err := u.copyToLayer(name); err != nil {
 			return err
 		}
@@ -60,13 +327,38 @@ func (u *CopyOnWriteUnionFs) Chmod(name string, mode os.FileMode) error {
 	return u.layer.Chmod(name, mode)
 }
 
+// cowFileInfo overrides Mode/ModTime from a metadata-only copy-up sidecar
+// while delegating everything else to the underlying base FileInfo.
+type cowFileInfo struct {
+	os.FileInfo
+	mode  os.FileMode
+	mtime time.Time
+}
+
+func (fi *cowFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *cowFileInfo) ModTime() time.Time { return fi.mtime }
+
 func (u *CopyOnWriteUnionFs) Stat(name string) (os.FileInfo, error) {
 	fi, err := u.layer.Stat(name)
 	switch err {
 	case nil:
 		return fi, nil
 	case syscall.ENOENT:
-		return u.base.Stat(name)
+		whiteout, werr := u.isWhiteout(name)
+		if werr != nil {
+			return nil, werr
+		}
+		if whiteout {
+			return nil, syscall.ENOENT
+		}
+		bfi, err := u.base.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if meta, ok, merr := u.readMeta(name); merr == nil && ok {
+			return &cowFileInfo{FileInfo: bfi, mode: meta.Mode, mtime: meta.Mtime}, nil
+		}
+		return bfi, nil
 	default:
 		return nil, err
 	}
@@ -84,51 +376,204 @@ func (u *CopyOnWriteUnionFs) Rename(oldname, newname string) error {
 	return u.layer.Rename(oldname, newname)
 }
 
-// Removing files present only in the base layer is not permitted. If
-// a file is present in the base layer and the overlay, only the overlay
-// will be removed.
+// Remove deletes name. If it is present in the overlay, the overlay copy
+// is removed directly. If it is also (or only) present in the base layer,
+// a whiteout marker is written to the overlay so the path is treated as
+// gone from the union, without ever touching the base layer itself.
 func (u *CopyOnWriteUnionFs) Remove(name string) error {
-	err := u.layer.Remove(name)
-	switch err {
-	case syscall.ENOENT:
-		_, err = u.base.Stat(name)
-		if err == nil {
-			return syscall.EPERM
+	whiteout, err := u.isWhiteout(name)
+	if err != nil {
+		return err
+	}
+	if whiteout {
+		// An opaque ancestor masks only base entries: a file created in the
+		// layer after the RemoveAll is still removed from the layer.
+		if _, lerr := u.layer.Stat(name); lerr != nil {
+			return syscall.ENOENT
 		}
-		return syscall.ENOENT
-	default:
+		return u.layer.Remove(name)
+	}
+
+	layerErr := u.layer.Remove(name)
+	if layerErr != nil && layerErr != syscall.ENOENT {
+		return layerErr
+	}
+	if err := u.removeMeta(name); err != nil {
 		return err
 	}
+	if _, err := u.base.Stat(name); err == nil {
+		return u.writeWhiteout(name)
+	}
+	if layerErr == syscall.ENOENT {
+		return syscall.ENOENT
+	}
+	return nil
 }
 
+// RemoveAll deletes name and any children. If name is a directory present
+// in the base layer, a single directory-level opaque marker is written
+// inside it instead of one whiteout per base child, so the directory
+// itself remains in the union as an empty directory.
 func (u *CopyOnWriteUnionFs) RemoveAll(name string) error {
-	err := u.layer.RemoveAll(name)
-	switch err {
-	case syscall.ENOENT:
-		_, err = u.base.Stat(name)
-		if err == nil {
-			return syscall.EPERM
+	layerErr := u.layer.RemoveAll(name)
+	if layerErr != nil && layerErr != syscall.ENOENT {
+		return layerErr
+	}
+	if err := u.removeMeta(name); err != nil {
+		return err
+	}
+	if fi, err := u.base.Stat(name); err == nil {
+		if fi.IsDir() {
+			return u.writeOpaque(name)
 		}
+		return u.writeWhiteout(name)
+	}
+	if layerErr == syscall.ENOENT {
 		return syscall.ENOENT
-	default:
-		return err
 	}
+	return nil
+}
+
+// dirEntryExists reports whether name is a directory on either side of the
+// union that Open/OpenFile should merge. A directory in the layer always
+// counts; a whiteout on name (or an opaque ancestor) hides only the base
+// directory.
+func (u *CopyOnWriteUnionFs) dirEntryExists(name string) (bool, error) {
+	if layerDir, _ := IsDir(u.layer, name); layerDir {
+		return true, nil
+	}
+	whiteout, err := u.isWhiteout(name)
+	if err != nil {
+		return false, err
+	}
+	if whiteout {
+		return false, nil
+	}
+	baseDir, _ := IsDir(u.base, name)
+	return baseDir, nil
+}
+
+// mergeDir opens name on whichever side has it and wraps the result(s) in a
+// filteredDirFile so Readdir/Readdirnames see base entries merged with
+// layer entries (layer wins on name collisions), honoring whiteouts.
+func (u *CopyOnWriteUnionFs) mergeDir(name string, flag int, perm os.FileMode) (File, error) {
+	bfile, _ := u.base.OpenFile(name, flag, perm)
+	lfile, err := u.layer.OpenFile(name, flag, perm)
+	if err != nil && bfile == nil {
+		return nil, err
+	}
+	return &filteredDirFile{UnionFile: &UnionFile{base: bfile, layer: lfile}, fs: u, name: name}, nil
+}
+
+// isHousekeepingName reports whether base is one of the overlay's own
+// bookkeeping files (a whiteout, the opaque marker, or a metadata-only
+// copy-up sidecar) that must never appear in a directory listing.
+func isHousekeepingName(base string) bool {
+	return base == whOpaque || strings.HasPrefix(base, whPrefix) || strings.HasPrefix(base, ".cow-meta.")
+}
+
+// filteredDirFile wraps a merged directory File so Readdir/Readdirnames
+// hide the overlay's own housekeeping files and any base entry masked by a
+// whiteout or an opaque marker, instead of leaking them as if they were
+// ordinary union entries.
+type filteredDirFile struct {
+	*UnionFile
+	fs   *CopyOnWriteUnionFs
+	name string
+}
+
+func (f *filteredDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	seen := map[string]os.FileInfo{}
+
+	if f.layer != nil {
+		infos, err := f.layer.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			if isHousekeepingName(fi.Name()) {
+				continue
+			}
+			seen[fi.Name()] = fi
+		}
+	}
+
+	if f.base != nil {
+		opaque, err := f.fs.isOpaque(f.name)
+		if err != nil {
+			return nil, err
+		}
+		if !opaque {
+			infos, err := f.base.Readdir(-1)
+			if err != nil {
+				return nil, err
+			}
+			for _, fi := range infos {
+				if _, ok := seen[fi.Name()]; ok {
+					continue
+				}
+				whiteout, err := f.fs.isWhiteout(filepath.Join(f.name, fi.Name()))
+				if err != nil {
+					return nil, err
+				}
+				if whiteout {
+					continue
+				}
+				seen[fi.Name()] = fi
+			}
+		}
+	}
+
+	out := make([]os.FileInfo, 0, len(seen))
+	for _, fi := range seen {
+		out = append(out, fi)
+	}
+	if count > 0 && count < len(out) {
+		out = out[:count]
+	}
+	return out, nil
+}
+
+func (f *filteredDirFile) Readdirnames(count int) ([]string, error) {
+	infos, err := f.Readdir(count)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(infos))
+	for i, fi := range infos {
+		names[i] = fi.Name()
+	}
+	return names, nil
 }
 
 func (u *CopyOnWriteUnionFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
 	b, err := u.isBaseFile(name)
-	if err != nil {
+	if err != nil && !(err == syscall.ENOENT && flag&os.O_CREATE != 0) {
 		return nil, err
 	}
 
 	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
-		if b {
+		if err == nil && b {
 			if err = u.copyToLayer(name); err != nil {
 				return nil, err
 			}
 		}
+		if err := u.clearWhiteout(name); err != nil {
+			return nil, err
+		}
+		if err := u.layer.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+			return nil, err
+		}
 		return u.layer.OpenFile(name, flag, perm)
 	}
+
+	isDir, err := u.dirEntryExists(name)
+	if err != nil {
+		return nil, err
+	}
+	if isDir {
+		return u.mergeDir(name, flag, perm)
+	}
 	if b {
 		return u.base.OpenFile(name, flag, perm)
 	}
@@ -140,34 +585,33 @@ func (u *CopyOnWriteUnionFs) Open(name string) (File, error) {
 	if err != nil {
 		return nil, err
 	}
-	if b {
-		return u.base.Open(name)
-	}
 
-	dir, err := IsDir(u.layer, name)
+	isDir, err := u.dirEntryExists(name)
 	if err != nil {
 		return nil, err
 	}
-	if !dir {
-		return u.layer.Open(name)
+	if isDir {
+		return u.mergeDir(name, os.O_RDONLY, 0)
 	}
-
-	bfile, _ := u.base.Open(name)
-	lfile, err := u.layer.Open(name)
-	if err != nil && bfile == nil {
-		return nil, err
+	if b {
+		return u.base.Open(name)
 	}
-	return &UnionFile{base: bfile, layer: lfile}, nil
+	return u.layer.Open(name)
 }
 
+// Mkdir on a path that is a directory in the base layer always reports
+// EEXIST, even if that base directory was previously masked by an opaque
+// marker (via RemoveAll): the directory logically still exists, so
+// recreating it must not resurrect its hidden base children by clearing
+// the marker.
 func (u *CopyOnWriteUnionFs) Mkdir(name string, perm os.FileMode) error {
 	dir, err := IsDir(u.base, name)
-	if err != nil {
-		return u.layer.MkdirAll(name, perm)
-	}
-	if dir {
+	if err == nil && dir {
 		return syscall.EEXIST
 	}
+	if err := u.clearWhiteout(name); err != nil {
+		return err
+	}
 	return u.layer.MkdirAll(name, perm)
 }
 
@@ -175,14 +619,15 @@ func (u *CopyOnWriteUnionFs) Name() string {
 	return "CopyOnWriteUnionFs"
 }
 
+// MkdirAll has the same opaque-preserving behavior as Mkdir.
 func (u *CopyOnWriteUnionFs) MkdirAll(name string, perm os.FileMode) error {
 	dir, err := IsDir(u.base, name)
-	if err != nil {
-		return u.layer.MkdirAll(name, perm)
-	}
-	if dir {
+	if err == nil && dir {
 		return syscall.EEXIST
 	}
+	if err := u.clearWhiteout(name); err != nil {
+		return err
+	}
 	return u.layer.MkdirAll(name, perm)
 }
 
@@ -193,5 +638,11 @@ func (u *CopyOnWriteUnionFs) Create(name string) (File, error) {
 			return nil, err
 		}
 	}
+	if err := u.clearWhiteout(name); err != nil {
+		return nil, err
+	}
+	if err := u.layer.MkdirAll(filepath.Dir(name), 0o777); err != nil {
+		return nil, err
+	}
 	return u.layer.Create(name)
 }
@@ -0,0 +1,390 @@
+package afero
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func newTestCow() (*CopyOnWriteUnionFs, Fs, Fs) {
+	base := NewMemMapFs()
+	layer := NewMemMapFs()
+	return NewCopyOnWriteFs(base, layer).(*CopyOnWriteUnionFs), base, layer
+}
+
+func TestCowRemoveBaseFileWhiteout(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := WriteFile(base, "/foo.txt", []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cow.Remove("/foo.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, err := cow.Stat("/foo.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat after Remove: got %v, want IsNotExist", err)
+	}
+	if _, err := base.Stat("/foo.txt"); err != nil {
+		t.Fatalf("base file must be untouched by a whiteout: %v", err)
+	}
+	if err := cow.Remove("/foo.txt"); !os.IsNotExist(err) {
+		t.Fatalf("second Remove: got %v, want IsNotExist", err)
+	}
+}
+
+func TestCowRecreateClearsWhiteout(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := WriteFile(base, "/foo.txt", []byte("base"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cow.Remove("/foo.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := cow.Create("/foo.txt")
+	if err != nil {
+		t.Fatalf("Create after Remove: %v", err)
+	}
+	f.Close()
+
+	if _, err := cow.Stat("/foo.txt"); err != nil {
+		t.Fatalf("Stat after recreate: %v", err)
+	}
+}
+
+func TestCowRemoveAllBaseDirOpaque(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := base.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/b.txt", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cow.RemoveAll("/dir"); err != nil {
+		t.Fatalf("RemoveAll: %v", err)
+	}
+	if _, err := cow.Stat("/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat /dir/a.txt after RemoveAll: got %v, want IsNotExist", err)
+	}
+	if _, err := cow.Stat("/dir/b.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat /dir/b.txt after RemoveAll: got %v, want IsNotExist", err)
+	}
+}
+
+func TestCowMkdirDoesNotResurrectOpaqueDir(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := base.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cow.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The classic "rm -rf dir && mkdir dir" pattern must not bring back the
+	// deleted base children.
+	if err := cow.Mkdir("/dir", 0755); err != syscall.EEXIST {
+		t.Fatalf("Mkdir on an opaque-masked base directory: got %v, want EEXIST", err)
+	}
+	if _, err := cow.Stat("/dir/a.txt"); !os.IsNotExist(err) {
+		t.Fatalf("Stat /dir/a.txt after Mkdir: got %v, want IsNotExist", err)
+	}
+}
+
+func TestCowOpenFileCreateOnNewPath(t *testing.T) {
+	cow, _, _ := newTestCow()
+
+	f, err := cow.OpenFile("/new.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile with O_CREATE on a brand-new path: %v", err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := cow.Stat("/new.txt"); err != nil {
+		t.Fatalf("Stat after OpenFile create: %v", err)
+	}
+}
+
+func readdirnames(t *testing.T, cow *CopyOnWriteUnionFs, name string) map[string]bool {
+	t.Helper()
+	f, err := cow.Open(name)
+	if err != nil {
+		t.Fatalf("Open(%s): %v", name, err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		t.Fatalf("Readdirnames(%s): %v", name, err)
+	}
+	got := map[string]bool{}
+	for _, n := range names {
+		got[n] = true
+	}
+	return got
+}
+
+func TestCowReaddirHidesWhitedOutFile(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := base.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/b.txt", []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(cow, "/dir/c.txt", []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cow.Remove("/dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readdirnames(t, cow, "/dir")
+	if got["a.txt"] {
+		t.Errorf("Readdirnames listed whited-out file a.txt: %v", got)
+	}
+	if !got["b.txt"] || !got["c.txt"] {
+		t.Errorf("Readdirnames missing expected entries: %v", got)
+	}
+	for n := range got {
+		if isHousekeepingName(n) {
+			t.Errorf("Readdirnames leaked housekeeping entry %q", n)
+		}
+	}
+}
+
+func TestCowReaddirHidesOpaqueDirChildren(t *testing.T) {
+	cow, base, _ := newTestCow()
+	if err := base.MkdirAll("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/dir/a.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cow.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(cow, "/dir/new.txt", []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readdirnames(t, cow, "/dir")
+	if got["a.txt"] {
+		t.Errorf("Readdirnames listed base child masked by an opaque marker: %v", got)
+	}
+	if !got["new.txt"] {
+		t.Errorf("Readdirnames missing layer entry written after RemoveAll: %v", got)
+	}
+}
+
+func TestCowMetadataOnlyCopyUp(t *testing.T) {
+	base := NewMemMapFs()
+	layer := NewMemMapFs()
+	if err := WriteFile(base, "/foo.txt", []byte("base content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cow := NewCopyOnWriteFsWithOptions(base, layer, CowOptions{MetadataOnlyCopyUp: true}).(*CopyOnWriteUnionFs)
+
+	if err := cow.Chmod("/foo.txt", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if _, err := layer.Stat("/foo.txt"); !os.IsNotExist(err) {
+		t.Fatalf("metadata-only Chmod must not copy file data into the layer, got err=%v", err)
+	}
+
+	fi, err := cow.Stat("/foo.txt")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if fi.Mode() != 0600 {
+		t.Errorf("Stat().Mode() = %v, want 0600", fi.Mode())
+	}
+
+	// A real write folds the pending metadata override into the layer copy.
+	f, err := cow.OpenFile("/foo.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile: %v", err)
+	}
+	f.Close()
+
+	lfi, err := layer.Stat("/foo.txt")
+	if err != nil {
+		t.Fatalf("layer Stat after copy-up: %v", err)
+	}
+	if lfi.Mode() != 0600 {
+		t.Errorf("layer file mode = %v, want folded-in 0600", lfi.Mode())
+	}
+}
+
+func TestCowMaxCopySize(t *testing.T) {
+	base := NewMemMapFs()
+	layer := NewMemMapFs()
+	if err := WriteFile(base, "/big.txt", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cow := NewCopyOnWriteFsWithOptions(base, layer, CowOptions{MaxCopySize: 4}).(*CopyOnWriteUnionFs)
+
+	if _, err := cow.OpenFile("/big.txt", os.O_WRONLY, 0); err != ErrCopyUpTooLarge {
+		t.Fatalf("OpenFile over MaxCopySize: got %v, want ErrCopyUpTooLarge", err)
+	}
+}
+
+func TestCowOnCopyUpCallback(t *testing.T) {
+	base := NewMemMapFs()
+	layer := NewMemMapFs()
+	if err := WriteFile(base, "/foo.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var copied []string
+	cow := NewCopyOnWriteFsWithOptions(base, layer, CowOptions{
+		OnCopyUp: func(name string) { copied = append(copied, name) },
+	}).(*CopyOnWriteUnionFs)
+
+	if err := cow.Chmod("/foo.txt", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if len(copied) != 1 || copied[0] != "/foo.txt" {
+		t.Errorf("OnCopyUp callback calls = %v, want a single call for /foo.txt", copied)
+	}
+}
+
+// strictLayerFs wraps an Fs but, unlike MemMapFs, refuses to create or open
+// a file whose parent directory was never explicitly created via MkdirAll.
+// It stands in for a backend without MemMapFs' implicit-parent-directory
+// behavior, to confirm CopyOnWriteUnionFs now calls MkdirAll itself instead
+// of relying on the layer to do it.
+type strictLayerFs struct {
+	Fs
+	known map[string]bool
+}
+
+func newStrictLayerFs() *strictLayerFs {
+	return &strictLayerFs{Fs: NewMemMapFs(), known: map[string]bool{"/": true, ".": true}}
+}
+
+func (s *strictLayerFs) MkdirAll(path string, perm os.FileMode) error {
+	if err := s.Fs.MkdirAll(path, perm); err != nil {
+		return err
+	}
+	s.known[path] = true
+	return nil
+}
+
+func (s *strictLayerFs) requireParent(name string) error {
+	dir := filepath.Dir(name)
+	if !s.known[dir] {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (s *strictLayerFs) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE != 0 {
+		if err := s.requireParent(name); err != nil {
+			return nil, err
+		}
+	}
+	return s.Fs.OpenFile(name, flag, perm)
+}
+
+func (s *strictLayerFs) Create(name string) (File, error) {
+	if err := s.requireParent(name); err != nil {
+		return nil, err
+	}
+	return s.Fs.Create(name)
+}
+
+func TestCowPluggableLayerBackend(t *testing.T) {
+	base := NewMemMapFs()
+	if err := base.MkdirAll("/nested/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFile(base, "/nested/dir/foo.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	layer := newStrictLayerFs()
+	cow := NewCopyOnWriteFs(base, layer)
+
+	f, err := cow.OpenFile("/nested/dir/foo.txt", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("OpenFile on a layer needing explicit MkdirAll: %v", err)
+	}
+	f.Close()
+
+	if err := cow.Remove("/nested/dir/foo.txt"); err != nil {
+		t.Fatalf("Remove (writes a whiteout) after copy-up: %v", err)
+	}
+}
+
+func TestCowCreateNewNestedPathOnStrictLayer(t *testing.T) {
+	base := NewMemMapFs()
+	layer := newStrictLayerFs()
+	cow := NewCopyOnWriteFs(base, layer)
+
+	f, err := cow.Create("/newdir/sub/new.txt")
+	if err != nil {
+		t.Fatalf("Create on a brand-new nested path: %v", err)
+	}
+	f.Close()
+
+	if _, err := cow.Stat("/newdir/sub/new.txt"); err != nil {
+		t.Fatalf("Stat after Create: %v", err)
+	}
+}
+
+func TestCowOpenFileCreateNewNestedPathOnStrictLayer(t *testing.T) {
+	base := NewMemMapFs()
+	layer := newStrictLayerFs()
+	cow := NewCopyOnWriteFs(base, layer)
+
+	f, err := cow.OpenFile("/newdir/sub/new.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatalf("OpenFile with O_CREATE on a brand-new nested path: %v", err)
+	}
+	f.Close()
+
+	if _, err := cow.Stat("/newdir/sub/new.txt"); err != nil {
+		t.Fatalf("Stat after OpenFile create: %v", err)
+	}
+}
+
+func TestCowRemoveCleansUpOrphanedMetaSidecar(t *testing.T) {
+	base := NewMemMapFs()
+	layer := NewMemMapFs()
+	if err := WriteFile(base, "/foo.txt", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cow := NewCopyOnWriteFsWithOptions(base, layer, CowOptions{MetadataOnlyCopyUp: true}).(*CopyOnWriteUnionFs)
+	if err := cow.Chmod("/foo.txt", 0600); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if _, ok, err := cow.readMeta("/foo.txt"); err != nil || !ok {
+		t.Fatalf("expected a pending metadata-only sidecar before Remove: ok=%v err=%v", ok, err)
+	}
+
+	if err := cow.Remove("/foo.txt"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if _, ok, err := cow.readMeta("/foo.txt"); err != nil || ok {
+		t.Errorf("sidecar for /foo.txt still present after Remove: ok=%v err=%v", ok, err)
+	}
+}